@@ -7,6 +7,7 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"github.com/orgrim/pg_happy/metrics"
 	"github.com/orgrim/pg_happy/pg"
 	"github.com/orgrim/pg_happy/store"
 	"github.com/spf13/cobra"
@@ -14,24 +15,48 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
 
+// lagWarnBytes is the replay lag, in bytes of WAL, above which verify
+// warns about a replica falling behind. Below it, the gap is expected
+// to fluctuate on any active load test as the primary's LSN keeps
+// advancing between the two probes.
+const lagWarnBytes = 16 * 1024 * 1024 // one default wal_segment_size
+
 var (
 	// Global options
-	ConnString string
-	LocalStore string
+	//
+	// DbURLs holds one or more connection strings. The first one is the
+	// primary used by every command; verify additionally treats the rest
+	// as replica targets.
+	DbURLs      []string
+	LocalStore  string
+	StoreDriver string
 
 	// Load options
 	Timeout  string
 	Pause    string
 	Truncate bool
 	Size     int
+	Mode     string
+
+	// Load options, copy mode
+	BatchSize     int
+	BatchInterval string
+	MaxRate       int
+
+	// Load options, metrics
+	MetricsAddr string
 
 	// Compare options
 	NoLoad bool
 
+	// Migrate options
+	MigrateVersion int
+
 	rootCmd = &cobra.Command{
 		Use:   "pg_happy",
 		Short: "A test application for HA setups of PostgreSQL",
@@ -61,22 +86,81 @@ failover.`,
 		Short: "Compare the local store with the database",
 		RunE:  compareDB,
 	}
+
+	verifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the local store against the primary and its replicas",
+		Long: `Verify checks, for every --db-url target, whether the rows recorded in
+the local store reached that target, using a read-only repeatable read
+snapshot so the check does not disturb a running load. It
+reports rows missing and present per target along with replication lag
+information.`,
+		RunE: verifyDB,
+	}
+
+	migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Manage the schema migrations of the application",
+		Long:  "Apply, roll back or inspect the versioned migrations of the application schema",
+	}
+
+	migrateUpCmd = &cobra.Command{
+		Use:   "up",
+		Short: "Apply pending migrations",
+		RunE:  migrateUp,
+	}
+
+	migrateDownCmd = &cobra.Command{
+		Use:   "down",
+		Short: "Roll back applied migrations",
+		RunE:  migrateDown,
+	}
+
+	migrateForceCmd = &cobra.Command{
+		Use:   "force <version>",
+		Short: "Force the recorded schema version without running migrations",
+		Long:  "Set the recorded schema version without running any migration, clearing the dirty flag left by a failed migration",
+		Args:  cobra.ExactArgs(1),
+		RunE:  migrateForce,
+	}
+
+	migrateVersionCmd = &cobra.Command{
+		Use:   "version",
+		Short: "Show the current schema version",
+		RunE:  migrateVersion,
+	}
 )
 
 func init() {
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(loadCmd)
 	rootCmd.AddCommand(compareCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.AddCommand(migrateUpCmd)
+	migrateCmd.AddCommand(migrateDownCmd)
+	migrateCmd.AddCommand(migrateForceCmd)
+	migrateCmd.AddCommand(migrateVersionCmd)
 
-	rootCmd.PersistentFlags().StringVarP(&ConnString, "db-url", "d", "", "connection string or URL to PostgreSQL")
+	rootCmd.PersistentFlags().StringArrayVarP(&DbURLs, "db-url", "d", nil, "connection string or URL to PostgreSQL, repeatable; the first value is the primary, verify checks the rest as replica targets")
 	rootCmd.PersistentFlags().StringVarP(&LocalStore, "store", "s", "/tmp/pg_happy.data", "path to the local file storing data send to PostgreSQL")
+	rootCmd.PersistentFlags().StringVar(&StoreDriver, "store-driver", "json", "backend for the local store: json or sqlite")
 
 	loadCmd.Flags().StringVarP(&Timeout, "timeout", "t", "5s", "timeout when interacting with PostgreSQL")
 	loadCmd.Flags().StringVarP(&Pause, "pause", "p", "500ms", "pause between transactions")
 	loadCmd.Flags().BoolVarP(&Truncate, "truncate", "T", false, "truncate tables and files before sending data")
 	loadCmd.Flags().IntVarP(&Size, "size", "S", 10, "payload size in bytes")
+	loadCmd.Flags().StringVarP(&Mode, "mode", "m", "single", "insertion mode: single (one row per transaction) or copy (batched COPY)")
+	loadCmd.Flags().IntVar(&BatchSize, "batch-size", 1000, "number of rows per batch in copy mode")
+	loadCmd.Flags().StringVar(&BatchInterval, "batch-interval", "1s", "maximum time to wait before flushing a partial batch in copy mode")
+	loadCmd.Flags().IntVar(&MaxRate, "max-rate", 0, "maximum rows per second in copy mode, 0 disables the limit")
+	loadCmd.Flags().StringVar(&MetricsAddr, "metrics-addr", "", "address to expose Prometheus metrics on (e.g. :9100), disabled if empty")
 
 	compareCmd.Flags().BoolVarP(&NoLoad, "no-load", "n", false, "do not load local file to database")
+
+	migrateUpCmd.Flags().IntVarP(&MigrateVersion, "to", "V", 0, "target version to migrate to, defaults to the latest migration")
+	migrateDownCmd.Flags().IntVarP(&MigrateVersion, "to", "V", 0, "target version to migrate down to")
 }
 
 // Execute run the application through cobra
@@ -84,12 +168,28 @@ func Execute(ctx context.Context) error {
 	return rootCmd.ExecuteContext(ctx)
 }
 
+// primaryDbURL returns the first --db-url value, the primary target used
+// by every command.
+func primaryDbURL() (string, error) {
+	if len(DbURLs) == 0 {
+		return "", fmt.Errorf("at least one --db-url is required")
+	}
+
+	return DbURLs[0], nil
+}
+
 func initDB(cmd *cobra.Command, args []string) error {
 	baseCtx := cmd.Context()
+
+	connString, err := primaryDbURL()
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(baseCtx, 5*time.Second)
 
 	// connect
-	db, err := pg.NewDB(ctx, ConnString)
+	db, err := pg.NewDB(ctx, connString)
 	cancel()
 	if err != nil {
 		return fmt.Errorf("could not connect: %w", err)
@@ -110,6 +210,17 @@ func initDB(cmd *cobra.Command, args []string) error {
 }
 
 func loadDB(cmd *cobra.Command, args []string) error {
+	switch Mode {
+	case "single":
+		return loadDBSingle(cmd, args)
+	case "copy":
+		return loadDBCopy(cmd, args)
+	default:
+		return fmt.Errorf("invalid mode: %s, must be one of single, copy", Mode)
+	}
+}
+
+func loadDBSingle(cmd *cobra.Command, args []string) error {
 	// process and validate options
 	timeout, err := time.ParseDuration(Timeout)
 	if err != nil {
@@ -137,11 +248,26 @@ func loadDB(cmd *cobra.Command, args []string) error {
 		connected bool
 	)
 
-	st, err := store.NewStore(LocalStore, Truncate)
+	st, err := store.Open(StoreDriver, LocalStore, Truncate)
 	if err != nil {
 		return err
 	}
 
+	recorder := metrics.NewRecorder()
+	if MetricsAddr != "" {
+		go func() {
+			if err := recorder.Serve(baseCtx, MetricsAddr); err != nil {
+				log.Printf("metrics server error: %s", err)
+			}
+		}()
+	}
+
+	defer func() {
+		if err := recorder.WriteReport(LocalStore + ".report.json"); err != nil {
+			log.Printf("could not write outage report: %s", err)
+		}
+	}()
+
 	log.Println("generating random payload")
 	payload := make([]byte, Size)
 	for i := 0; i < Size; i++ {
@@ -164,17 +290,21 @@ mainLoop:
 
 		// get a connection
 		if !connected {
-			var err error
+			connString, err := primaryDbURL()
+			if err != nil {
+				return err
+			}
 
 			ctx, cancel := context.WithTimeout(baseCtx, timeout)
 			log.Println("connecting to PostgreSQL")
-			db, err = pg.NewDB(ctx, ConnString)
+			db, err = pg.NewDB(ctx, connString)
 			if err != nil {
 				if ctx.Err() == context.Canceled {
 					return nil
 				}
 
 				log.Printf("could not connect: %s", err)
+				recorder.ConnectionLost(id)
 				cancel()
 				time.Sleep(pause)
 				continue
@@ -230,14 +360,22 @@ mainLoop:
 
 		// insert the same data into the database
 		log.Printf("insert data: id=%d\n", id)
+		insertStart := time.Now()
 		err := pg.InsertData(baseCtx, db, timeout, id, ts, string(payload))
+		insertDuration := time.Since(insertStart)
+
 		if err != nil {
 			log.Printf("could not insert (%v, %v): %s", id, ts, err)
+			recorder.RecordInsert("error", insertDuration)
+		} else {
+			recorder.RecordInsert("ok", insertDuration)
+			recorder.ConnectionRestored()
 		}
 
 		// Force reconnection
 		if db.Conn.IsClosed() {
 			connected = false
+			recorder.ConnectionLost(id)
 		}
 
 		id++
@@ -248,20 +386,291 @@ mainLoop:
 	return nil
 }
 
+// rateLimiter is a simple token-bucket limiter capping throughput to
+// ratePerSecond tokens per second. A nil *rateLimiter never blocks.
+type rateLimiter struct {
+	tokens chan struct{}
+	stop   chan struct{}
+}
+
+func newRateLimiter(ratePerSecond int) *rateLimiter {
+	if ratePerSecond <= 0 {
+		return nil
+	}
+
+	rl := &rateLimiter{
+		tokens: make(chan struct{}, ratePerSecond),
+		stop:   make(chan struct{}),
+	}
+
+	go rl.fill(time.Second / time.Duration(ratePerSecond))
+
+	return rl
+}
+
+func (rl *rateLimiter) fill(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case rl.tokens <- struct{}{}:
+			default:
+			}
+		case <-rl.stop:
+			return
+		}
+	}
+}
+
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	if rl == nil {
+		return nil
+	}
+
+	select {
+	case <-rl.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (rl *rateLimiter) Close() {
+	if rl != nil {
+		close(rl.stop)
+	}
+}
+
+func loadDBCopy(cmd *cobra.Command, args []string) error {
+	// process and validate options
+	timeout, err := time.ParseDuration(Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid timeout value: %w", err)
+	}
+
+	pause, err := time.ParseDuration(Pause)
+	if err != nil {
+		return fmt.Errorf("invalid pause value: %w", err)
+	}
+
+	batchInterval, err := time.ParseDuration(BatchInterval)
+	if err != nil {
+		return fmt.Errorf("invalid batch-interval value: %w", err)
+	}
+
+	if Size <= 0 {
+		return fmt.Errorf("invalid size for payload: too small")
+	}
+
+	if BatchSize <= 0 {
+		return fmt.Errorf("invalid batch size: too small")
+	}
+
+	baseCtx, baseCancel := context.WithCancel(cmd.Context())
+
+	// Setup
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
+
+	var (
+		db        *pg.DB
+		id        int
+		connected bool
+	)
+
+	st, err := store.Open(StoreDriver, LocalStore, Truncate)
+	if err != nil {
+		return err
+	}
+
+	limiter := newRateLimiter(MaxRate)
+	defer limiter.Close()
+
+	recorder := metrics.NewRecorder()
+	if MetricsAddr != "" {
+		go func() {
+			if err := recorder.Serve(baseCtx, MetricsAddr); err != nil {
+				log.Printf("metrics server error: %s", err)
+			}
+		}()
+	}
+
+	var down bool
+
+	defer func() {
+		if err := recorder.WriteReport(LocalStore + ".report.json"); err != nil {
+			log.Printf("could not write outage report: %s", err)
+		}
+	}()
+
+	batch := make([]store.StoreData, 0, BatchSize)
+	lastFlush := time.Now()
+	var pendingFlush bool
+
+mainLoop:
+	for {
+		// end the loop if requested
+		select {
+		case sig := <-sigC:
+			log.Printf("received signal %s, exiting", sig)
+			baseCancel()
+			break mainLoop
+		default:
+		}
+
+		// get a connection
+		if !connected {
+			connString, err := primaryDbURL()
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := context.WithTimeout(baseCtx, timeout)
+			log.Println("connecting to PostgreSQL")
+			db, err = pg.NewDB(ctx, connString)
+			canceled := ctx.Err() == context.Canceled
+			cancel()
+			if err != nil {
+				if canceled {
+					return nil
+				}
+
+				log.Printf("could not connect: %s", err)
+				down = true
+				recorder.ConnectionLost(id)
+				time.Sleep(pause)
+				continue
+			}
+
+			connected = true
+
+			defer db.CloseWithTimeout(baseCtx, timeout)
+		}
+
+		// avoid unicity violation by getting the greatest id on first run
+		if id == 0 {
+			var err error
+
+			ctx, cancel := context.WithTimeout(baseCtx, timeout)
+
+			if Truncate {
+				log.Println("truncating tables")
+				err = pg.TruncateTables(ctx, db)
+				cancel()
+				if err != nil {
+					log.Printf("could not truncate tables: %s\n", err)
+				}
+
+				id = 1
+			} else {
+				log.Println("getting next id")
+				id, err = pg.GetNextId(ctx, db)
+				cancel()
+				if err != nil {
+					log.Printf("could not get next id: %s", err)
+				}
+			}
+
+			if err != nil {
+				if db.Conn.IsClosed() {
+					connected = false
+				}
+
+				time.Sleep(pause)
+				continue
+			}
+
+			log.Printf("next id is: %d\n", id)
+		}
+
+		if err := limiter.wait(baseCtx); err != nil {
+			break mainLoop
+		}
+
+		// while a batch is awaiting a retry, keep resending it as-is
+		// instead of appending more rows on top of it
+		if !pendingFlush {
+			payload := make([]byte, Size)
+			for i := 0; i < Size; i++ {
+				// generate a number between 32 and 126, the ascii visible
+				// characters
+				c := (rand.Uint32() & 94) + 32
+				payload[i] = byte(c)
+			}
+
+			batch = append(batch, store.StoreData{Id: id, Ts: time.Now(), Payload: string(payload)})
+			id++
+
+			if len(batch) < BatchSize && time.Since(lastFlush) < batchInterval {
+				continue
+			}
+		}
+
+		log.Printf("copying batch of %d rows\n", len(batch))
+		copyStart := time.Now()
+		ctx, cancel := context.WithTimeout(baseCtx, timeout)
+		_, err = pg.CopyStamps(ctx, db, batch)
+		cancel()
+		copyDuration := time.Since(copyStart)
+
+		if err != nil {
+			log.Printf("could not copy batch: %s", err)
+			recorder.RecordInsert("error", copyDuration)
+			pendingFlush = true
+
+			if db.Conn.IsClosed() {
+				connected = false
+				down = true
+				recorder.ConnectionLost(batch[0].Id)
+			}
+
+			time.Sleep(pause)
+			continue
+		}
+
+		recorder.RecordInsert("ok", copyDuration)
+
+		if down {
+			recorder.ConnectionRestored()
+			down = false
+		}
+
+		// only mark the batch as sent in the local store once the COPY has
+		// committed, so a mid-batch failover is still detectable by compare
+		if err := st.AppendBatch(batch); err != nil {
+			return fmt.Errorf("could not store batch: %w", err)
+		}
+
+		batch = batch[:0]
+		pendingFlush = false
+		lastFlush = time.Now()
+	}
+
+	return nil
+}
+
 func compareDB(cmd *cobra.Command, args []string) error {
 	baseCtx := cmd.Context()
 	timeout := 5 * time.Second
 
-	st, err := store.NewStore(LocalStore, false)
+	st, err := store.Open(StoreDriver, LocalStore, false)
 	if err != nil {
 		return err
 	}
 
 	defer st.Close()
 
+	connString, err := primaryDbURL()
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithTimeout(baseCtx, timeout)
 	log.Println("connecting to PostgreSQL")
-	db, err := pg.NewDB(ctx, ConnString)
+	db, err := pg.NewDB(ctx, connString)
 	cancel()
 	if err != nil {
 		return fmt.Errorf("could not connect: %w", err)
@@ -272,8 +681,14 @@ func compareDB(cmd *cobra.Command, args []string) error {
 	// copy all the data from the file to the database
 	if !NoLoad {
 		log.Println("copying store to database")
+
+		it, err := st.Iterator()
+		if err != nil {
+			return err
+		}
+
 		ctx, cancel = context.WithTimeout(baseCtx, timeout)
-		count, err := pg.CopyStore(ctx, db, st)
+		count, err := pg.CopyStore(ctx, db, it)
 		cancel()
 		if err != nil {
 			return err
@@ -298,3 +713,192 @@ func compareDB(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+func verifyDB(cmd *cobra.Command, args []string) error {
+	baseCtx := cmd.Context()
+	timeout := 5 * time.Second
+
+	if len(DbURLs) == 0 {
+		return fmt.Errorf("at least one --db-url is required")
+	}
+
+	st, err := store.Open(StoreDriver, LocalStore, false)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	expected, err := st.Load()
+	if err != nil {
+		return fmt.Errorf("could not load local store: %w", err)
+	}
+
+	ids := make(map[int]struct{}, len(expected))
+	for id := range expected {
+		ids[id] = struct{}{}
+	}
+
+	var primaryLSN string
+
+	for i, url := range DbURLs {
+		role := "replica"
+		if i == 0 {
+			role = "primary"
+		}
+
+		ctx, cancel := context.WithTimeout(baseCtx, timeout)
+		db, err := pg.NewDB(ctx, url)
+		cancel()
+		if err != nil {
+			log.Printf("%s %s: could not connect: %s", role, url, err)
+			continue
+		}
+
+		ctx, cancel = context.WithTimeout(baseCtx, timeout)
+		report, err := pg.VerifyTarget(ctx, db, ids)
+		cancel()
+
+		db.CloseWithTimeout(baseCtx, timeout)
+
+		if err != nil {
+			log.Printf("%s %s: could not verify: %s", role, url, err)
+			continue
+		}
+
+		if i == 0 {
+			primaryLSN = report.CurrentLSN
+		}
+
+		log.Printf("%s %s: present=%d missing=%d max_id=%d current_lsn=%s replay_lsn=%s",
+			role, url, report.Present, len(report.MissingIds), report.MaxId, report.CurrentLSN, report.ReplayLSN)
+
+		for _, id := range report.MissingIds {
+			log.Printf("%s %s: missing id=%d ts=%s", role, url, id, expected[id].Ts)
+		}
+
+		if i > 0 && report.ReplayLSN != "" && primaryLSN != "" {
+			if lag, ok := pg.LSNLagBytes(primaryLSN, report.ReplayLSN); ok && lag > lagWarnBytes {
+				log.Printf("%s %s: replay lsn %s lags primary's current lsn %s by %d bytes",
+					role, url, report.ReplayLSN, primaryLSN, lag)
+			}
+		}
+	}
+
+	return nil
+}
+
+func connectForMigration(cmd *cobra.Command) (context.Context, *pg.DB, error) {
+	baseCtx := cmd.Context()
+	timeout := 5 * time.Second
+
+	connString, err := primaryDbURL()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(baseCtx, timeout)
+	defer cancel()
+
+	db, err := pg.NewDB(ctx, connString)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not connect: %w", err)
+	}
+
+	return baseCtx, db, nil
+}
+
+func migrateUp(cmd *cobra.Command, args []string) error {
+	baseCtx, db, err := connectForMigration(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.CloseWithTimeout(baseCtx, 5*time.Second)
+
+	target := MigrateVersion
+	if target == 0 {
+		target, err = pg.LatestMigrationVersion()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(baseCtx, 30*time.Second)
+	defer cancel()
+
+	version, err := pg.MigrateUp(ctx, db, target)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("schema migrated to version %d", version)
+
+	return nil
+}
+
+func migrateDown(cmd *cobra.Command, args []string) error {
+	baseCtx, db, err := connectForMigration(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.CloseWithTimeout(baseCtx, 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(baseCtx, 30*time.Second)
+	defer cancel()
+
+	version, err := pg.MigrateDown(ctx, db, MigrateVersion)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("schema migrated down to version %d", version)
+
+	return nil
+}
+
+func migrateForce(cmd *cobra.Command, args []string) error {
+	version, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid version: %w", err)
+	}
+
+	baseCtx, db, err := connectForMigration(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.CloseWithTimeout(baseCtx, 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(baseCtx, 5*time.Second)
+	defer cancel()
+
+	if err := pg.Force(ctx, db, version); err != nil {
+		return err
+	}
+
+	log.Printf("schema version forced to %d", version)
+
+	return nil
+}
+
+func migrateVersion(cmd *cobra.Command, args []string) error {
+	baseCtx, db, err := connectForMigration(cmd)
+	if err != nil {
+		return err
+	}
+	defer db.CloseWithTimeout(baseCtx, 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(baseCtx, 5*time.Second)
+	defer cancel()
+
+	version, dirty, err := pg.SchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		log.Printf("version %d (dirty)", version)
+	} else {
+		log.Printf("version %d", version)
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2022, Nicolas Thauvin All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Package metrics exposes Prometheus metrics for pg_happy load runs and
+// keeps track of connection outages so a structured report can be
+// written out on shutdown.
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outage records one period during which the database connection was
+// unavailable, along with the ids passed to ConnectionLost when the
+// outage was first and last noticed (see ConnectionLost for what those
+// ids are).
+type Outage struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	FirstID int       `json:"first_id"`
+	LastID  int       `json:"last_id"`
+}
+
+// Report is the structured summary written on shutdown, so the missing
+// ids reported by compare can later be correlated with a specific outage.
+type Report struct {
+	Outages []Outage `json:"outages"`
+}
+
+// Recorder tracks the Prometheus metrics for a load run and the outage
+// windows needed for the shutdown report.
+type Recorder struct {
+	registry       *prometheus.Registry
+	inserts        *prometheus.CounterVec
+	insertDuration prometheus.Histogram
+	reconnects     prometheus.Counter
+	connState      prometheus.Gauge
+	outageSeconds  prometheus.Gauge
+
+	mu          sync.Mutex
+	outageStart time.Time
+	firstFailID int
+	lastFailID  int
+	outages     []Outage
+}
+
+// NewRecorder creates a Recorder with its own registry, so several
+// Recorders (or test runs) never collide on Prometheus' default one.
+func NewRecorder() *Recorder {
+	r := &Recorder{
+		registry: prometheus.NewRegistry(),
+		inserts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pg_happy_inserts_total",
+			Help: "Number of rows pg_happy attempted to insert, by result.",
+		}, []string{"result"}),
+		insertDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "pg_happy_insert_duration_seconds",
+			Help:    "Duration of insert or copy operations against PostgreSQL.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pg_happy_reconnects_total",
+			Help: "Number of times pg_happy recovered from a lost connection.",
+		}),
+		connState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pg_happy_connection_state",
+			Help: "1 if pg_happy believes it is connected to PostgreSQL, 0 otherwise.",
+		}),
+		outageSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pg_happy_outage_seconds",
+			Help: "Seconds elapsed since the start of the current outage, 0 when connected.",
+		}),
+	}
+
+	r.registry.MustRegister(r.inserts, r.insertDuration, r.reconnects, r.connState, r.outageSeconds)
+
+	// A Recorder starts out believing it is disconnected: the caller
+	// has not connected yet, and ConnectionRestored only fires after a
+	// successful insert, so the gauge should not claim a connection
+	// that doesn't exist.
+	r.connState.Set(0)
+
+	return r
+}
+
+// Serve starts the metrics HTTP server on addr and runs until ctx is
+// canceled, shutting the server down gracefully.
+func (r *Recorder) Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- srv.ListenAndServe()
+	}()
+
+	go r.tickOutage(ctx)
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		return srv.Shutdown(shutdownCtx)
+	case err := <-errC:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+
+		return fmt.Errorf("metrics server failed: %w", err)
+	}
+}
+
+// tickOutage keeps pg_happy_outage_seconds increasing while an outage is
+// in progress, rather than only updating it when the outage ends.
+func (r *Recorder) tickOutage(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			if !r.outageStart.IsZero() {
+				r.outageSeconds.Set(time.Since(r.outageStart).Seconds())
+			}
+			r.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RecordInsert records the outcome and duration of one insert or COPY
+// operation.
+func (r *Recorder) RecordInsert(result string, duration time.Duration) {
+	r.inserts.WithLabelValues(result).Inc()
+	r.insertDuration.Observe(duration.Seconds())
+}
+
+// ConnectionLost marks the database connection as down, opening an
+// outage window if one isn't already in progress. id becomes the
+// window's first id when it opens it, and its last id in every case.
+// pg_happy load passes the row being written when the connection was
+// found closed (the first row of the batch in copy mode), or the next
+// row to write when a connection attempt fails, so the recorded range
+// can include a row that was written successfully after the outage.
+func (r *Recorder) ConnectionLost(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.connState.Set(0)
+
+	if r.outageStart.IsZero() {
+		r.outageStart = time.Now()
+		r.firstFailID = id
+	}
+
+	r.lastFailID = id
+}
+
+// ConnectionRestored closes out the current outage window, if any, and
+// records it for the shutdown report. Callers should only call this once
+// a reconnect is followed by a successful insert, not merely once the
+// TCP connection is back, so a flapping connection that never manages to
+// write anything still counts as one ongoing outage.
+func (r *Recorder) ConnectionRestored() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.connState.Set(1)
+
+	if r.outageStart.IsZero() {
+		return
+	}
+
+	r.reconnects.Inc()
+
+	r.outages = append(r.outages, Outage{
+		Start:   r.outageStart,
+		End:     time.Now(),
+		FirstID: r.firstFailID,
+		LastID:  r.lastFailID,
+	})
+
+	r.outageStart = time.Time{}
+	r.outageSeconds.Set(0)
+}
+
+// WriteReport writes the outage windows detected during the run as JSON
+// to path. An outage still in progress is included, with the time of
+// the call as its end.
+func (r *Recorder) WriteReport(path string) error {
+	r.mu.Lock()
+	report := Report{Outages: append([]Outage(nil), r.outages...)}
+	if !r.outageStart.IsZero() {
+		report.Outages = append(report.Outages, Outage{
+			Start:   r.outageStart,
+			End:     time.Now(),
+			FirstID: r.firstFailID,
+			LastID:  r.lastFailID,
+		})
+	}
+	r.mu.Unlock()
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode outage report: %w", err)
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("could not write outage report: %w", err)
+	}
+
+	return nil
+}
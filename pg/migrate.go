@@ -0,0 +1,255 @@
+// Copyright (c) 2022, Nicolas Thauvin All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package pg
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsLockID is the key used to take a session level advisory lock
+// while migrations are applied, so concurrent pg_happy runs against the
+// same database don't step on each other.
+const migrationsLockID = 7267686170 // hex ASCII codes of "rghap", arbitrary
+
+var migrationNameRe = regexp.MustCompile(`^(\d+)_[^.]+\.(up|down)\.sql$`)
+
+type migration struct {
+	version int
+	up      string
+	down    string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("could not read embedded migrations: %w", err)
+	}
+
+	byVersion := make(map[int]*migration)
+
+	for _, e := range entries {
+		m := migrationNameRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", e.Name(), err)
+		}
+
+		content, err := migrationFiles.ReadFile("migrations/" + e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %s: %w", e.Name(), err)
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{version: version}
+			byVersion[version] = mig
+		}
+
+		if strings.HasSuffix(m[2], "up") {
+			mig.up = string(content)
+		} else {
+			mig.down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	return migrations, nil
+}
+
+// LatestMigrationVersion returns the version of the most recent embedded
+// migration.
+func LatestMigrationVersion() (int, error) {
+	return latestMigrationVersion()
+}
+
+func latestMigrationVersion() (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	target := 0
+	for _, m := range migrations {
+		if m.version > target {
+			target = m.version
+		}
+	}
+
+	return target, nil
+}
+
+func ensureMigrationsTable(ctx context.Context, d *DB) error {
+	sqlCommands := []string{
+		"create schema if not exists happy",
+		"create table if not exists happy.schema_migrations ( version int not null, dirty boolean not null default false )",
+	}
+
+	return runXact(ctx, d, sqlCommands)
+}
+
+func lockMigrations(ctx context.Context, d *DB) error {
+	if _, err := d.Conn.Exec(ctx, "select pg_advisory_lock($1)", migrationsLockID); err != nil {
+		return fmt.Errorf("could not acquire migration lock: %w", err)
+	}
+
+	return nil
+}
+
+func unlockMigrations(ctx context.Context, d *DB) error {
+	if _, err := d.Conn.Exec(ctx, "select pg_advisory_unlock($1)", migrationsLockID); err != nil {
+		return fmt.Errorf("could not release migration lock: %w", err)
+	}
+
+	return nil
+}
+
+func currentVersion(ctx context.Context, d *DB) (int, bool, error) {
+	var (
+		version int
+		dirty   bool
+	)
+
+	err := d.Conn.QueryRow(ctx, "select version, dirty from happy.schema_migrations limit 1").Scan(&version, &dirty)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, false, nil
+		}
+
+		return 0, false, fmt.Errorf("could not read schema_migrations: %w", err)
+	}
+
+	return version, dirty, nil
+}
+
+func setVersion(ctx context.Context, d *DB, version int, dirty bool) error {
+	if err := runXact(ctx, d, []string{"delete from happy.schema_migrations"}); err != nil {
+		return err
+	}
+
+	if _, err := d.Conn.Exec(ctx, "insert into happy.schema_migrations (version, dirty) values ($1, $2)", version, dirty); err != nil {
+		return fmt.Errorf("could not record schema version: %w", err)
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, d *DB, newVersion int, script string) error {
+	if err := setVersion(ctx, d, newVersion, true); err != nil {
+		return err
+	}
+
+	if err := runXact(ctx, d, []string{script}); err != nil {
+		return fmt.Errorf("migration to version %d failed, database left dirty: %w", newVersion, err)
+	}
+
+	return setVersion(ctx, d, newVersion, false)
+}
+
+func runMigrations(ctx context.Context, d *DB, target int, up bool) (int, error) {
+	if err := lockMigrations(ctx, d); err != nil {
+		return 0, err
+	}
+	defer unlockMigrations(ctx, d)
+
+	if err := ensureMigrationsTable(ctx, d); err != nil {
+		return 0, err
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	version, dirty, err := currentVersion(ctx, d)
+	if err != nil {
+		return 0, err
+	}
+
+	if dirty {
+		return version, fmt.Errorf("database is marked dirty at version %d, run 'pg_happy migrate force' to fix it", version)
+	}
+
+	if up {
+		for _, m := range migrations {
+			if m.version <= version || m.version > target {
+				continue
+			}
+
+			if err := applyMigration(ctx, d, m.version, m.up); err != nil {
+				return version, err
+			}
+
+			version = m.version
+		}
+	} else {
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if m.version > version || m.version <= target {
+				continue
+			}
+
+			if err := applyMigration(ctx, d, m.version-1, m.down); err != nil {
+				return version, err
+			}
+
+			version = m.version - 1
+		}
+	}
+
+	return version, nil
+}
+
+// MigrateUp applies pending up migrations until the schema reaches target.
+func MigrateUp(ctx context.Context, d *DB, target int) (int, error) {
+	return runMigrations(ctx, d, target, true)
+}
+
+// MigrateDown applies down migrations until the schema reaches target.
+func MigrateDown(ctx context.Context, d *DB, target int) (int, error) {
+	return runMigrations(ctx, d, target, false)
+}
+
+// Force sets the recorded schema version without running any migration,
+// clearing the dirty flag. It is used to recover from a migration that
+// failed partway through.
+func Force(ctx context.Context, d *DB, version int) error {
+	if err := ensureMigrationsTable(ctx, d); err != nil {
+		return err
+	}
+
+	return setVersion(ctx, d, version, false)
+}
+
+// SchemaVersion returns the currently recorded migration version and
+// whether the schema was left in a dirty state by a failed migration.
+func SchemaVersion(ctx context.Context, d *DB) (int, bool, error) {
+	if err := ensureMigrationsTable(ctx, d); err != nil {
+		return 0, false, err
+	}
+
+	return currentVersion(ctx, d)
+}
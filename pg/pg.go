@@ -60,13 +60,13 @@ func runXact(ctx context.Context, d *DB, sqlCommands []string) error {
 }
 
 func CreateSchema(ctx context.Context, d *DB) error {
-	sqlCommands := []string{
-		"create schema if not exists happy",
-		"create table if not exists happy.stamps ( id int primary key, ts timestamptz not null )",
-		"create unlogged table if not exists happy.store ( id int primary key, ts timestamptz not null )",
+	target, err := latestMigrationVersion()
+	if err != nil {
+		return err
 	}
 
-	return runXact(ctx, d, sqlCommands)
+	_, err = MigrateUp(ctx, d, target)
+	return err
 }
 
 func TruncateTables(ctx context.Context, d *DB) error {
@@ -78,7 +78,7 @@ func TruncateTables(ctx context.Context, d *DB) error {
 	return runXact(ctx, d, sqlCommands)
 }
 
-func InsertData(ctx context.Context, d *DB, timeout time.Duration, id int, ts time.Time) error {
+func InsertData(ctx context.Context, d *DB, timeout time.Duration, id int, ts time.Time, payload string) error {
 	insCtx, cancel := context.WithTimeout(ctx, timeout)
 	tx, err := d.Conn.Begin(insCtx)
 	cancel()
@@ -87,7 +87,7 @@ func InsertData(ctx context.Context, d *DB, timeout time.Duration, id int, ts ti
 	}
 
 	insCtx, cancel = context.WithTimeout(ctx, timeout)
-	_, err = tx.Exec(insCtx, "insert into happy.stamps (id, ts) values ($1, $2)", id, ts)
+	_, err = tx.Exec(insCtx, "insert into happy.stamps (id, ts, payload) values ($1, $2, $3)", id, ts, payload)
 	cancel()
 	if err != nil {
 		werr := fmt.Errorf("query failed: %w", err)
@@ -125,8 +125,33 @@ func GetNextId(ctx context.Context, d *DB) (int, error) {
 	return id, nil
 }
 
-func CopyStore(ctx context.Context, d *DB, st *store.Store) (int64, error) {
-	count, err := d.Conn.CopyFrom(ctx, pgx.Identifier{"happy", "store"}, []string{"id", "ts"}, st)
+// storeCopySource adapts a store.RowIter to pgx.CopyFromSource, so any
+// store backend can be streamed to PostgreSQL via COPY.
+type storeCopySource struct {
+	it  store.RowIter
+	cur store.StoreData
+}
+
+func (s *storeCopySource) Next() bool {
+	if !s.it.Next() {
+		return false
+	}
+
+	s.cur = s.it.Value()
+
+	return true
+}
+
+func (s *storeCopySource) Values() ([]interface{}, error) {
+	return []interface{}{s.cur.Id, s.cur.Ts, s.cur.Payload}, nil
+}
+
+func (s *storeCopySource) Err() error {
+	return s.it.Err()
+}
+
+func CopyStore(ctx context.Context, d *DB, it store.RowIter) (int64, error) {
+	count, err := d.Conn.CopyFrom(ctx, pgx.Identifier{"happy", "store"}, []string{"id", "ts", "payload"}, &storeCopySource{it: it})
 	if err != nil {
 		return 0, fmt.Errorf("could not load store contents to database: %w", err)
 	}
@@ -134,6 +159,23 @@ func CopyStore(ctx context.Context, d *DB, st *store.Store) (int64, error) {
 	return count, nil
 }
 
+// CopyStamps streams a batch of rows straight into happy.stamps using the
+// COPY protocol, for the high-throughput load mode. It is the COPY
+// equivalent of InsertData.
+func CopyStamps(ctx context.Context, d *DB, batch []store.StoreData) (int64, error) {
+	rows := make([][]interface{}, len(batch))
+	for i, r := range batch {
+		rows[i] = []interface{}{r.Id, r.Ts, r.Payload}
+	}
+
+	count, err := d.Conn.CopyFrom(ctx, pgx.Identifier{"happy", "stamps"}, []string{"id", "ts", "payload"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		return 0, fmt.Errorf("could not copy batch to database: %w", err)
+	}
+
+	return count, nil
+}
+
 func Compare(ctx context.Context, d *DB) ([]store.StoreData, error) {
 	rows, err := d.Conn.Query(ctx, "select r.id, r.ts from happy.stamps s full join happy.store r using (id) where s.id is null;")
 	if err != nil {
@@ -0,0 +1,142 @@
+// Copyright (c) 2022, Nicolas Thauvin All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package pg
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// TargetReport summarizes the result of verifying one --db-url target
+// against the set of ids expected to be there.
+type TargetReport struct {
+	MissingIds []int
+	Present    int
+	MaxId      int
+	CurrentLSN string // pg_current_wal_lsn(), set when the target is a primary
+	ReplayLSN  string // pg_last_wal_replay_lsn(), set when the target is a standby
+}
+
+// walInfo probes pg_current_wal_lsn() and pg_last_wal_replay_lsn()
+// independently of the verification snapshot. Only one of them succeeds
+// depending on whether the target is a primary or a standby, and a
+// failed query would otherwise abort the snapshot transaction.
+func walInfo(ctx context.Context, d *DB) (current string, replay string) {
+	_ = d.Conn.QueryRow(ctx, "select pg_current_wal_lsn()::text").Scan(&current)
+	_ = d.Conn.QueryRow(ctx, "select pg_last_wal_replay_lsn()::text").Scan(&replay)
+
+	return current, replay
+}
+
+// parseLSN turns a PostgreSQL LSN of the form "X/Y" into the byte
+// offset it represents, so two LSNs can be compared numerically
+// instead of as strings.
+func parseLSN(lsn string) (uint64, error) {
+	hi, lo, ok := strings.Cut(lsn, "/")
+	if !ok {
+		return 0, fmt.Errorf("malformed lsn: %q", lsn)
+	}
+
+	hiBits, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed lsn: %q", lsn)
+	}
+
+	loBits, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed lsn: %q", lsn)
+	}
+
+	return hiBits<<32 | loBits, nil
+}
+
+// LSNLagBytes returns how far behind replay is from current, in bytes
+// of WAL. It reports ok=false if either LSN can't be parsed, so callers
+// don't mistake a parse failure for "perfectly in sync".
+func LSNLagBytes(current, replay string) (lag int64, ok bool) {
+	c, err := parseLSN(current)
+	if err != nil {
+		return 0, false
+	}
+
+	r, err := parseLSN(replay)
+	if err != nil {
+		return 0, false
+	}
+
+	if r > c {
+		return 0, true
+	}
+
+	return int64(c - r), true
+}
+
+// VerifyTarget opens a read-only repeatable read snapshot against d and
+// reports which of the expected ids made it to happy.stamps, without
+// writing anything to the target. Repeatable read is used because hot
+// standbys refuse serializable transactions; the Deferrable option only
+// takes effect on serializable transactions, so it has no effect here.
+func VerifyTarget(ctx context.Context, d *DB, expected map[int]struct{}) (TargetReport, error) {
+	current, replay := walInfo(ctx, d)
+
+	tx, err := d.Conn.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:       pgx.RepeatableRead,
+		AccessMode:     pgx.ReadOnly,
+		DeferrableMode: pgx.Deferrable,
+	})
+	if err != nil {
+		return TargetReport{}, fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, "select id from happy.stamps")
+	if err != nil {
+		return TargetReport{}, fmt.Errorf("could not query happy.stamps: %w", err)
+	}
+
+	seen := make(map[int]struct{}, len(expected))
+	maxId := 0
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return TargetReport{}, err
+		}
+
+		seen[id] = struct{}{}
+		if id > maxId {
+			maxId = id
+		}
+	}
+
+	rows.Close()
+	if rows.Err() != nil {
+		return TargetReport{}, rows.Err()
+	}
+
+	report := TargetReport{
+		MaxId:      maxId,
+		CurrentLSN: current,
+		ReplayLSN:  replay,
+	}
+
+	for id := range expected {
+		if _, ok := seen[id]; ok {
+			report.Present++
+		} else {
+			report.MissingIds = append(report.MissingIds, id)
+		}
+	}
+
+	sort.Ints(report.MissingIds)
+
+	return report, nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022, Nicolas Thauvin All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// jsonStore is the original store backend: rows are appended to a file as
+// newline-delimited JSON. It is simple and dependency-free, but a scan
+// over the whole file is needed to iterate or load it, and a short write
+// (e.g. a crash mid-Append) can corrupt the last line.
+type jsonStore struct {
+	path string
+	fd   *os.File
+}
+
+func newJSONStore(path string, truncate bool) (*jsonStore, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if truncate {
+		flags = flags | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file: %w", err)
+	}
+
+	return &jsonStore{path: path, fd: f}, nil
+}
+
+func (s *jsonStore) Close() error {
+	return s.fd.Close()
+}
+
+func (s *jsonStore) Append(id int, ts time.Time) error {
+	return s.AppendData(StoreData{Id: id, Ts: ts})
+}
+
+func (s *jsonStore) AppendData(data StoreData) error {
+	return s.AppendBatch([]StoreData{data})
+}
+
+// AppendBatch seeks to the end of the store once, then encodes and writes
+// the rows of the batch one after the other as newline-delimited JSON. It
+// is not atomic: a short write can leave only the first rows of the batch
+// in the file, the last of them possibly cut short.
+func (s *jsonStore) AppendBatch(batch []StoreData) error {
+	if _, err := s.fd.Seek(0, os.SEEK_END); err != nil {
+		return fmt.Errorf("could not seek to the end of the store: %w", err)
+	}
+
+	enc := json.NewEncoder(s.fd)
+	for _, data := range batch {
+		if err := enc.Encode(data); err != nil {
+			return fmt.Errorf("could not encode id: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *jsonStore) Truncate() error {
+	if err := s.fd.Truncate(0); err != nil {
+		return fmt.Errorf("could not truncate store: %w", err)
+	}
+
+	_, err := s.fd.Seek(0, os.SEEK_SET)
+	return err
+}
+
+// jsonRowIter scans a jsonStore from the beginning of the file.
+type jsonRowIter struct {
+	decoder     *json.Decoder
+	decodedData StoreData
+	decodeError error
+	count       int
+}
+
+func (s *jsonStore) Iterator() (RowIter, error) {
+	if _, err := s.fd.Seek(0, os.SEEK_SET); err != nil {
+		return nil, fmt.Errorf("could not seek to the start of the store: %w", err)
+	}
+
+	return &jsonRowIter{decoder: json.NewDecoder(s.fd)}, nil
+}
+
+func (it *jsonRowIter) Next() bool {
+	datum := StoreData{}
+
+	if err := it.decoder.Decode(&datum); err != nil {
+		if err != io.EOF {
+			it.decodeError = fmt.Errorf("decode error: %w (row %d)", err, it.count)
+		}
+		return false
+	}
+
+	it.decodedData = datum
+	it.count++
+
+	return true
+}
+
+func (it *jsonRowIter) Value() StoreData {
+	return it.decodedData
+}
+
+func (it *jsonRowIter) Err() error {
+	return it.decodeError
+}
+
+func (s *jsonStore) Load() (map[int]StoreData, error) {
+	it, err := s.Iterator()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[int]StoreData)
+	for it.Next() {
+		row := it.Value()
+		data[row.Id] = row
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2022, Nicolas Thauvin All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStore is a store.Store backend on top of a SQLite database,
+// using database/sql so it stays driver-agnostic. Unlike jsonStore, it
+// does not need a full file scan to iterate or load, tolerates a short
+// write without corrupting previously committed rows, and in WAL mode
+// lets several pg_happy load processes share one store file.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string, truncate bool) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open sqlite store: %w", err)
+	}
+
+	if _, err := db.Exec("pragma journal_mode=WAL"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not enable WAL mode: %w", err)
+	}
+
+	// Without a busy timeout, a writer that collides with another
+	// process' transaction gets an immediate "database is locked"
+	// error instead of waiting for it to finish, defeating the point
+	// of sharing one store file between several pg_happy load
+	// processes.
+	if _, err := db.Exec("pragma busy_timeout=5000"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not set busy timeout: %w", err)
+	}
+
+	if _, err := db.Exec("create table if not exists rows ( id integer primary key, ts integer not null, payload text not null default '' )"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create rows table: %w", err)
+	}
+
+	// SQLite only allows one writer at a time anyway; pinning the pool
+	// to a single connection avoids a goroutine in this process
+	// blocking on its own busy_timeout against itself.
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{db: db}
+
+	if truncate {
+		if err := s.Truncate(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStore) Append(id int, ts time.Time) error {
+	return s.AppendData(StoreData{Id: id, Ts: ts})
+}
+
+func (s *sqliteStore) AppendData(data StoreData) error {
+	return s.AppendBatch([]StoreData{data})
+}
+
+func (s *sqliteStore) AppendBatch(batch []StoreData) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+
+	stmt, err := tx.Prepare("insert into rows (id, ts, payload) values (?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("could not prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, row := range batch {
+		if _, err := stmt.Exec(row.Id, row.Ts.UnixNano(), row.Payload); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("could not insert row: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit batch: %w", err)
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Truncate() error {
+	if _, err := s.db.Exec("delete from rows"); err != nil {
+		return fmt.Errorf("could not truncate store: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteRowIter streams rows out of the store ordered by id, to feed
+// pg.CopyStore without loading everything in memory.
+type sqliteRowIter struct {
+	rows *sql.Rows
+	cur  StoreData
+	err  error
+}
+
+func (s *sqliteStore) Iterator() (RowIter, error) {
+	rows, err := s.db.Query("select id, ts, payload from rows order by id")
+	if err != nil {
+		return nil, fmt.Errorf("could not query rows: %w", err)
+	}
+
+	return &sqliteRowIter{rows: rows}, nil
+}
+
+func (it *sqliteRowIter) Next() bool {
+	if !it.rows.Next() {
+		it.err = it.rows.Err()
+		it.rows.Close()
+		return false
+	}
+
+	var (
+		id      int
+		tsNano  int64
+		payload string
+	)
+
+	if err := it.rows.Scan(&id, &tsNano, &payload); err != nil {
+		it.err = err
+		it.rows.Close()
+		return false
+	}
+
+	it.cur = StoreData{Id: id, Ts: time.Unix(0, tsNano), Payload: payload}
+
+	return true
+}
+
+func (it *sqliteRowIter) Value() StoreData {
+	return it.cur
+}
+
+func (it *sqliteRowIter) Err() error {
+	return it.err
+}
+
+func (s *sqliteStore) Load() (map[int]StoreData, error) {
+	it, err := s.Iterator()
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[int]StoreData)
+	for it.Next() {
+		row := it.Value()
+		data[row.Id] = row
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
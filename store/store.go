@@ -2,102 +2,71 @@
 // Use of this source code is governed by a BSD-style license that can be found
 // in the LICENSE file.
 
+// Package store keeps the local record of the rows pg_happy sent to
+// PostgreSQL, so they can later be compared against what actually landed
+// in the database.
 package store
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
-	"os"
 	"time"
 )
 
 type StoreData struct {
-	Id int
-	Ts time.Time
+	Id      int
+	Ts      time.Time
+	Payload string
 }
 
-type Store struct {
-	Path        string
-	fd          *os.File
-	count       int
-	decodeError error
-	decodedData StoreData
-	decoder     *json.Decoder
+// RowIter streams the rows of a Store, notably to feed pgx.CopyFrom in
+// pg.CopyStore without loading everything in memory. The sqlite backend
+// yields rows in id order, the json backend in the order they were
+// appended.
+type RowIter interface {
+	Next() bool
+	Value() StoreData
+	Err() error
 }
 
-func NewStore(path string, truncate bool) (*Store, error) {
-	s := Store{Path: path}
+// Store is the local record of data sent to PostgreSQL. Implementations
+// must allow Append/AppendBatch to be called while a previous Iterator or
+// Load is no longer in use; they are not required to support concurrent
+// use of several of these methods at once.
+type Store interface {
+	// Append records a single row.
+	Append(id int, ts time.Time) error
 
-	flags := os.O_RDWR | os.O_CREATE
-	if truncate {
-		flags = flags | os.O_TRUNC
-	}
-
-	f, err := os.OpenFile(path, flags, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("could not open file: %w", err)
-	}
+	// AppendData records a single row with its payload.
+	AppendData(data StoreData) error
 
-	s.fd = f
+	// AppendBatch records a batch of rows. The sqlite backend commits
+	// the batch in one transaction; the json backend writes it row by
+	// row, so a failed call can leave part of the batch recorded.
+	AppendBatch(batch []StoreData) error
 
-	return &s, nil
-}
+	// Iterator returns a RowIter over all recorded rows, in the order
+	// described on RowIter.
+	Iterator() (RowIter, error)
 
-func (s *Store) Close() error {
-	return s.fd.Close()
-}
+	// Load reads the whole store into memory, keyed by id.
+	Load() (map[int]StoreData, error)
 
-func (s *Store) Append(id int, ts time.Time) error {
-	data := StoreData{
-		Id: id,
-		Ts: ts,
-	}
+	// Truncate discards every recorded row.
+	Truncate() error
 
-	_, err := s.fd.Seek(0, os.SEEK_END)
-	if err != nil {
-		return fmt.Errorf("could not seek to the end of the store: %w", err)
-	}
-
-	enc := json.NewEncoder(s.fd)
-	if err := enc.Encode(data); err != nil {
-		return fmt.Errorf("could not encode id: %w", err)
-	}
-
-	return nil
+	// Close releases the resources held by the store.
+	Close() error
 }
 
-//
-func (s *Store) Next() bool {
-	if s.decoder == nil {
-		s.decoder = json.NewDecoder(s.fd)
+// Open opens the store at path using the given driver, creating it if it
+// does not exist yet. driver is one of "json" (the default) or "sqlite".
+func Open(driver, path string, truncate bool) (Store, error) {
+	switch driver {
+	case "", "json":
+		return newJSONStore(path, truncate)
+	case "sqlite":
+		return newSQLiteStore(path, truncate)
+	default:
+		return nil, fmt.Errorf("unknown store driver: %s", driver)
 	}
-
-	datum := StoreData{}
-
-	if err := s.decoder.Decode(&datum); err != nil {
-		if err != io.EOF {
-			s.decodeError = fmt.Errorf("decode error: %w (%d)", err, s.count)
-		}
-		return false
-	}
-
-	s.decodedData = datum
-	s.count++
-
-	return true
-}
-
-func (s *Store) Values() ([]interface{}, error) {
-	// Put the data found by Next() in a list in the correct order
-	values := make([]interface{}, 0)
-
-	values = append(values, s.decodedData.Id)
-	values = append(values, s.decodedData.Ts)
-
-	return values, nil
-}
-
-func (s *Store) Err() error {
-	return s.decodeError
 }